@@ -19,14 +19,35 @@ import (
 
 var log = logging.Logger("statetree")
 
+// SnapshotID identifies a point the actor cache can be reverted back to.
+type SnapshotID int
+
+type actorCacheLayer map[address.Address]*types.Actor
+
+// snapshotFrame is the bookkeeping pushed onto the snapshot stack by
+// Snapshot: how deep the actorcache layer stack was. The idCache entries
+// added after a snapshot are tracked separately, in idCacheGen.
+type snapshotFrame struct {
+	cacheEpoch int
+}
+
 type StateTree struct {
 	root  *hamt.Node
 	Store *hamt.CborIpldStore
 
-	actorcache map[address.Address]*types.Actor
-	snapshot   cid.Cid
+	// actorcache is a stack of copy-on-write layers: index 0 holds actors
+	// read back from the hamt (and is safe to keep across reverts), and
+	// each Snapshot pushes a new layer that SetActor/MutateActor write to.
+	// GetActor walks the stack top-down so a reverted layer's mutations
+	// never leak into the layers below it.
+	actorcache []actorCacheLayer
+	snapshots  []snapshotFrame
 
 	idCache *lru.LRU
+	// idCacheGen records, for each idCache entry, how many snapshots were
+	// open when it was added, so Revert can purge the ones added after
+	// the snapshot being reverted to.
+	idCacheGen map[address.Address]int
 }
 
 func NewStateTree(cst *hamt.CborIpldStore) (*StateTree, error) {
@@ -37,8 +58,9 @@ func NewStateTree(cst *hamt.CborIpldStore) (*StateTree, error) {
 	return &StateTree{
 		root:       hamt.NewNode(cst),
 		Store:      cst,
-		actorcache: make(map[address.Address]*types.Actor),
+		actorcache: []actorCacheLayer{{}},
 		idCache:    idCache,
+		idCacheGen: make(map[address.Address]int),
 	}, nil
 }
 
@@ -57,8 +79,9 @@ func LoadStateTree(cst *hamt.CborIpldStore, c cid.Cid) (*StateTree, error) {
 	return &StateTree{
 		root:       nd,
 		Store:      cst,
-		actorcache: make(map[address.Address]*types.Actor),
+		actorcache: []actorCacheLayer{{}},
 		idCache:    idCache,
+		idCacheGen: make(map[address.Address]int),
 	}, nil
 }
 
@@ -69,16 +92,13 @@ func (st *StateTree) SetActor(addr address.Address, act *types.Actor) error {
 	}
 	addr = iaddr
 
-	cact, ok := st.actorcache[addr]
-	if ok {
-		if act == cact {
-			return nil
-		}
+	top := st.actorcache[len(st.actorcache)-1]
+	if cact, ok := top[addr]; ok && cact == act {
+		return nil
 	}
 
-	st.actorcache[addr] = act
-
-	return st.root.Set(context.TODO(), string(addr.Bytes()), act)
+	top[addr] = act
+	return nil
 }
 
 func (st *StateTree) LookupID(addr address.Address) (address.Address, error) {
@@ -106,6 +126,7 @@ func (st *StateTree) LookupID(addr address.Address) (address.Address, error) {
 	}
 
 	st.idCache.Add(addr, id)
+	st.idCacheGen[addr] = len(st.snapshots)
 	return id.(address.Address), nil
 }
 
@@ -123,9 +144,10 @@ func (st *StateTree) GetActor(addr address.Address) (*types.Actor, error) {
 	}
 	addr = iaddr
 
-	cact, ok := st.actorcache[addr]
-	if ok {
-		return cact, nil
+	for i := len(st.actorcache) - 1; i >= 0; i-- {
+		if act, ok := st.actorcache[i][addr]; ok {
+			return act, nil
+		}
 	}
 
 	var act types.Actor
@@ -137,7 +159,9 @@ func (st *StateTree) GetActor(addr address.Address) (*types.Actor, error) {
 		return nil, xerrors.Errorf("hamt find failed: %w", err)
 	}
 
-	st.actorcache[addr] = &act
+	// Cache reads in the base layer: it reflects on-disk state, so it
+	// stays valid no matter how many snapshots above it get reverted.
+	st.actorcache[0][addr] = &act
 
 	return &act, nil
 }
@@ -146,12 +170,16 @@ func (st *StateTree) Flush(ctx context.Context) (cid.Cid, error) {
 	ctx, span := trace.StartSpan(ctx, "stateTree.Flush")
 	defer span.End()
 
-	for addr, act := range st.actorcache {
+	if len(st.snapshots) != 0 {
+		return cid.Undef, xerrors.Errorf("cannot Flush with %d snapshot(s) still open", len(st.snapshots))
+	}
+
+	for addr, act := range st.actorcache[0] {
 		if err := st.root.Set(ctx, string(addr.Bytes()), act); err != nil {
 			return cid.Undef, err
 		}
 	}
-	st.actorcache = make(map[address.Address]*types.Actor)
+	st.actorcache = []actorCacheLayer{{}}
 
 	if err := st.root.Flush(ctx); err != nil {
 		return cid.Undef, err
@@ -160,19 +188,66 @@ func (st *StateTree) Flush(ctx context.Context) (cid.Cid, error) {
 	return st.Store.Put(ctx, st.root)
 }
 
-func (st *StateTree) Snapshot(ctx context.Context) error {
-	ctx, span := trace.StartSpan(ctx, "stateTree.SnapShot")
+// Snapshot pushes a new copy-on-write actor cache layer and returns an ID
+// that can later be passed to Revert to undo everything written since.
+// Unlike the old CID-based snapshot, this touches neither the hamt root
+// nor the store, so nested message execution (internal sends, call
+// chains) can snapshot around every inner call without paying for a
+// Flush each time.
+func (st *StateTree) Snapshot(ctx context.Context) (SnapshotID, error) {
+	_, span := trace.StartSpan(ctx, "stateTree.Snapshot")
 	defer span.End()
 
-	ss, err := st.Flush(ctx)
-	if err != nil {
-		return err
+	sid := SnapshotID(len(st.snapshots))
+
+	st.snapshots = append(st.snapshots, snapshotFrame{
+		cacheEpoch: len(st.actorcache),
+	})
+	st.actorcache = append(st.actorcache, actorCacheLayer{})
+
+	return sid, nil
+}
+
+// Revert discards every actor mutation and idCache entry made since the
+// given snapshot was taken, popping the snapshot stack back down to it.
+func (st *StateTree) Revert(sid SnapshotID) error {
+	if int(sid) < 0 || int(sid) >= len(st.snapshots) {
+		return xerrors.Errorf("no such snapshot %d", sid)
+	}
+
+	frame := st.snapshots[sid]
+	st.actorcache = st.actorcache[:frame.cacheEpoch]
+	st.snapshots = st.snapshots[:sid]
+
+	for addr, gen := range st.idCacheGen {
+		if gen > int(sid) {
+			st.idCache.Remove(addr)
+			delete(st.idCacheGen, addr)
+		}
 	}
 
-	st.snapshot = ss
 	return nil
 }
 
+// ClearSnapshots forgets the snapshot stack, folding every open layer's
+// mutations down into the base actor cache so they can no longer be
+// reverted. Call this once a message (and all of its internal sends) has
+// finished executing successfully.
+func (st *StateTree) ClearSnapshots() {
+	if len(st.actorcache) > 1 {
+		base := st.actorcache[0]
+		for i := 1; i < len(st.actorcache); i++ {
+			for addr, act := range st.actorcache[i] {
+				base[addr] = act
+			}
+		}
+		st.actorcache = []actorCacheLayer{base}
+	}
+
+	st.snapshots = nil
+	st.idCacheGen = make(map[address.Address]int)
+}
+
 func (st *StateTree) RegisterNewAddress(addr address.Address, act *types.Actor) (address.Address, error) {
 	var out address.Address
 	err := st.MutateActor(actors.InitAddress, func(initact *types.Actor) error {
@@ -206,29 +281,21 @@ func (st *StateTree) RegisterNewAddress(addr address.Address, act *types.Actor)
 	return out, nil
 }
 
-func (st *StateTree) Revert() error {
-	nd, err := hamt.LoadNode(context.Background(), st.Store, st.snapshot)
-	if err != nil {
-		return err
-	}
-
-	// TODO: should it clean actorcache? Probably yes
-
-	st.idCache.Purge()
-
-	st.root = nd
-	return nil
-}
-
 func (st *StateTree) MutateActor(addr address.Address, f func(*types.Actor) error) error {
 	act, err := st.GetActor(addr)
 	if err != nil {
 		return err
 	}
 
-	if err := f(act); err != nil {
+	// act may be cached in a layer below the current top of the actor
+	// cache stack (the base layer, or an outer snapshot's layer). Mutate
+	// a copy rather than act itself, so a Revert of the current layer
+	// can't be defeated by f's in-place edit already having landed in a
+	// layer the revert doesn't touch.
+	cp := *act
+	if err := f(&cp); err != nil {
 		return err
 	}
 
-	return st.SetActor(addr, act)
+	return st.SetActor(addr, &cp)
 }
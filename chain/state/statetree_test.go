@@ -0,0 +1,162 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	hamt "github.com/ipfs/go-hamt-ipld"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func testStateTree(t *testing.T) *StateTree {
+	t.Helper()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	cst := hamt.CSTFromBstore(bs)
+
+	st, err := NewStateTree(cst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func idAddr(t *testing.T, id uint64) address.Address {
+	t.Helper()
+
+	a, err := address.NewIDAddress(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRevertDiscardsMutationMadeSinceSnapshot(t *testing.T) {
+	st := testStateTree(t)
+	addr := idAddr(t, 1000)
+
+	if err := st.SetActor(addr, &types.Actor{Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	sid, err := st.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.MutateActor(addr, func(act *types.Actor) error {
+		act.Nonce = 2
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := st.GetActor(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Nonce != 2 {
+		t.Fatalf("expected mutated nonce 2 before revert, got %d", act.Nonce)
+	}
+
+	if err := st.Revert(sid); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err = st.GetActor(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Nonce != 1 {
+		t.Fatalf("expected reverted nonce 1, got %d", act.Nonce)
+	}
+}
+
+// TestMutateActorDoesNotAliasLowerLayer guards against a MutateActor
+// regression where it mutated the *types.Actor returned by GetActor in
+// place, before SetActor ever copied it into the current snapshot layer.
+// Since GetActor can return a pointer cached in a layer below the one
+// MutateActor is about to write to, that in-place edit corrupted the
+// lower layer immediately, so Revert popping the top layer didn't
+// actually undo anything.
+func TestMutateActorDoesNotAliasLowerLayer(t *testing.T) {
+	st := testStateTree(t)
+	addr := idAddr(t, 1001)
+
+	if err := st.SetActor(addr, &types.Actor{Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := st.GetActor(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid, err := st.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.MutateActor(addr, func(act *types.Actor) error {
+		act.Nonce = 2
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if base.Nonce != 1 {
+		t.Fatalf("MutateActor mutated the base layer's actor in place: nonce = %d", base.Nonce)
+	}
+
+	if err := st.Revert(sid); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := st.GetActor(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Nonce != 1 {
+		t.Fatalf("expected reverted nonce 1, got %d", act.Nonce)
+	}
+}
+
+func TestClearSnapshotsKeepsPendingMutations(t *testing.T) {
+	st := testStateTree(t)
+	addr := idAddr(t, 1002)
+
+	if err := st.SetActor(addr, &types.Actor{Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.MutateActor(addr, func(act *types.Actor) error {
+		act.Nonce = 2
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	st.ClearSnapshots()
+
+	act, err := st.GetActor(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Nonce != 2 {
+		t.Fatalf("expected nonce 2 to survive ClearSnapshots, got %d", act.Nonce)
+	}
+
+	if err := st.Revert(SnapshotID(0)); err == nil {
+		t.Fatal("expected Revert to fail after ClearSnapshots dropped the snapshot stack")
+	}
+}
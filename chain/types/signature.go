@@ -0,0 +1,164 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/xerrors"
+
+	ffi "github.com/filecoin-project/filecoin-ffi"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/crypto"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	sigverify "github.com/filecoin-project/lotus/lib/sigs"
+)
+
+// Signature is a cryptographic signature, tagged with the scheme used to
+// produce it.
+type Signature struct {
+	Type crypto.SigType
+	Data []byte
+}
+
+func (s *Signature) Equals(o *Signature) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	return s.Type == o.Type && bytes.Equal(s.Data, o.Data)
+}
+
+func (s *Signature) MarshalCBOR(w io.Writer) error {
+	if s == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	buf := make([]byte, 1+len(s.Data))
+	buf[0] = byte(s.Type)
+	copy(buf[1:], s.Data)
+
+	return cbg.WriteByteArray(w, buf)
+}
+
+func (s *Signature) UnmarshalCBOR(br io.Reader) error {
+	buf, err := cbg.ReadByteArray(br, cbg.ByteArrayMaxLen)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return fmt.Errorf("signature data was empty")
+	}
+
+	s.Type = crypto.SigType(buf[0])
+	s.Data = buf[1:]
+
+	return nil
+}
+
+// Verify checks that the signature was produced by addr over msg.
+func (s *Signature) Verify(addr address.Address, msg []byte) error {
+	return sigverify.Verify(s, addr, msg)
+}
+
+// AggregateSignatures combines a set of BLS signatures into a single
+// aggregated BLS signature that VerifyAggregate can check with one
+// pairing instead of one per input signature. All inputs must be
+// SigTypeBLS; there is no meaningful aggregate of Secp256k1 signatures.
+func AggregateSignatures(sigs []*Signature) (*Signature, error) {
+	if len(sigs) == 0 {
+		return nil, xerrors.Errorf("cannot aggregate an empty signature set")
+	}
+
+	raw := make([]ffi.Signature, len(sigs))
+	for i, sig := range sigs {
+		if sig.Type != crypto.SigTypeBLS {
+			return nil, xerrors.Errorf("cannot aggregate signature %d: not BLS (type %d)", i, sig.Type)
+		}
+		if len(sig.Data) != len(raw[i]) {
+			return nil, xerrors.Errorf("cannot aggregate signature %d: expected %d bytes, got %d", i, len(raw[i]), len(sig.Data))
+		}
+		copy(raw[i][:], sig.Data)
+	}
+
+	agg := ffi.Aggregate(raw)
+	if agg == nil {
+		return nil, xerrors.Errorf("bls aggregation failed")
+	}
+
+	return &Signature{
+		Type: crypto.SigTypeBLS,
+		Data: agg[:],
+	}, nil
+}
+
+// VerifyAggregate checks an aggregated BLS signature against the
+// pubkeys/messages it was produced from, in one pairing check.
+func VerifyAggregate(pubkeys []address.Address, msgs [][]byte, agg *Signature) error {
+	if agg.Type != crypto.SigTypeBLS {
+		return xerrors.Errorf("cannot aggregate-verify a non-BLS signature")
+	}
+	if len(pubkeys) != len(msgs) {
+		return xerrors.Errorf("mismatched pubkey/message count for aggregate verification: %d != %d", len(pubkeys), len(msgs))
+	}
+
+	digests := make([]ffi.Digest, len(msgs))
+	for i, m := range msgs {
+		digests[i] = ffi.Hash(m)
+	}
+
+	pks := make([]ffi.PublicKey, len(pubkeys))
+	for i, a := range pubkeys {
+		if a.Protocol() != address.BLS {
+			return xerrors.Errorf("pubkey %d (%s) is not a BLS address", i, a)
+		}
+		if len(a.Payload()) != len(pks[i]) {
+			return xerrors.Errorf("pubkey %d (%s): expected %d bytes, got %d", i, a, len(pks[i]), len(a.Payload()))
+		}
+		copy(pks[i][:], a.Payload())
+	}
+
+	var sig ffi.Signature
+	if len(agg.Data) != len(sig) {
+		return xerrors.Errorf("aggregate signature: expected %d bytes, got %d", len(sig), len(agg.Data))
+	}
+	copy(sig[:], agg.Data)
+
+	if !ffi.HashVerify(sig, digests, pks) {
+		return xerrors.Errorf("bls aggregate signature verification failed")
+	}
+
+	return nil
+}
+
+// VerifyBatch verifies a batch of signatures against their corresponding
+// addresses and messages. When every signature is BLS it aggregates them
+// and runs a single pairing check; as soon as it sees a Secp256k1
+// signature in the batch it falls back to verifying each signature
+// individually instead. This is the entry point block/message validation
+// should call to check all of a block's BLS-signed messages together
+// instead of verifying them one at a time.
+func VerifyBatch(pubkeys []address.Address, msgs [][]byte, batch []*Signature) error {
+	if len(pubkeys) != len(msgs) || len(msgs) != len(batch) {
+		return xerrors.Errorf("mismatched pubkey/message/signature count: %d/%d/%d", len(pubkeys), len(msgs), len(batch))
+	}
+
+	for _, sig := range batch {
+		if sig.Type != crypto.SigTypeBLS {
+			for i, s := range batch {
+				if err := s.Verify(pubkeys[i], msgs[i]); err != nil {
+					return xerrors.Errorf("verifying signature %d: %w", i, err)
+				}
+			}
+			return nil
+		}
+	}
+
+	agg, err := AggregateSignatures(batch)
+	if err != nil {
+		return xerrors.Errorf("aggregating batch: %w", err)
+	}
+
+	return VerifyAggregate(pubkeys, msgs, agg)
+}
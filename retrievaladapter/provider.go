@@ -2,6 +2,8 @@ package retrievaladapter
 
 import (
 	"context"
+	"sync"
+
 	"github.com/filecoin-project/lotus/lib/sharedutils"
 
 	"github.com/filecoin-project/go-fil-components/retrievalmarket"
@@ -12,17 +14,25 @@ import (
 	"github.com/filecoin-project/lotus/storage/sectorblocks"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipld/go-ipld-prime"
 )
 
 type retrievalProviderNode struct {
 	sectorBlocks *sectorblocks.SectorBlocks
 	full         api.FullNode
+
+	matchedLk   sync.Mutex
+	matchedSize map[retrievaltypes.DealID]uint64
 }
 
 // NewRetrievalProviderNode returns a new node adapter for a retrieval provider that talks to the
 // Lotus Node
 func NewRetrievalProviderNode(sectorBlocks *sectorblocks.SectorBlocks, full api.FullNode) retrievalmarket.RetrievalProviderNode {
-	return &retrievalProviderNode{sectorBlocks, full}
+	return &retrievalProviderNode{
+		sectorBlocks: sectorBlocks,
+		full:         full,
+		matchedSize:  map[retrievaltypes.DealID]uint64{},
+	}
 }
 
 func (rpn *retrievalProviderNode) GetPieceSize(pieceCid []byte) (uint64, error) {
@@ -37,6 +47,54 @@ func (rpn *retrievalProviderNode) SealedBlockstore(approveUnseal func() error) b
 	return rpn.sectorBlocks.SealedBlockstore(approveUnseal)
 }
 
+// SealedCARBlockstore serves pieceCid out of its sector's CARv2 payload
+// instead of unsealing the whole sector, sharing the open file across
+// concurrent retrievals of the same piece. If sel is non-nil, only the
+// sub-DAG it matches is served, so a Graphsync request for one file (or
+// one HAMT directory) out of a piece doesn't ship the whole piece, and
+// each block the walk matches is credited to dealID via SelectorMatched
+// for payment accounting.
+func (rpn *retrievalProviderNode) SealedCARBlockstore(dealID retrievaltypes.DealID, pieceCid []byte, sel ipld.Node, approveUnseal func() error) (sectorblocks.ClosableBlockstore, error) {
+	asCid, err := cid.Cast(pieceCid)
+	if err != nil {
+		return nil, err
+	}
+
+	var onMatch func(c cid.Cid, size uint64)
+	if sel != nil {
+		onMatch = func(c cid.Cid, size uint64) {
+			_ = rpn.SelectorMatched(dealID, c, size)
+		}
+	}
+
+	return rpn.sectorBlocks.SealedCARBlockstore(asCid, sel, onMatch, approveUnseal)
+}
+
+// GetDealsForPiece returns every deal known to have stored pieceCid, so a
+// client can be matched to whichever deal already has the piece on hand.
+func (rpn *retrievalProviderNode) GetDealsForPiece(pieceCid cid.Cid) ([]sectorblocks.DealInfo, error) {
+	return rpn.sectorBlocks.GetDealsForPiece(pieceCid)
+}
+
+// LookupPieceForCID returns the piece payloadCid was stored in, letting a
+// client retrieve by the CID it actually wants instead of needing to
+// already know which piece contains it.
+func (rpn *retrievalProviderNode) LookupPieceForCID(payloadCid cid.Cid) (cid.Cid, error) {
+	return rpn.sectorBlocks.LookupPieceForCID(payloadCid)
+}
+
+// SelectorMatched is called for each block a deal's Graphsync selector
+// walk matches when SealedCARBlockstore resolves the selector, so the
+// provider can track how many bytes of the piece the selector covers for
+// payment accounting.
+func (rpn *retrievalProviderNode) SelectorMatched(dealID retrievaltypes.DealID, _ cid.Cid, size uint64) error {
+	rpn.matchedLk.Lock()
+	defer rpn.matchedLk.Unlock()
+
+	rpn.matchedSize[dealID] += size
+	return nil
+}
+
 func (rpn *retrievalProviderNode) SavePaymentVoucher(ctx context.Context, paymentChannel retrievaladdress.Address, voucher *retrievaltypes.SignedVoucher, proof []byte, expectedAmount retrievaltoken.TokenAmount) (retrievaltoken.TokenAmount, error) {
 	localVoucher, err := sharedutils.FromSharedSignedVoucher(voucher)
 	if err != nil {
@@ -44,4 +102,4 @@ func (rpn *retrievalProviderNode) SavePaymentVoucher(ctx context.Context, paymen
 	}
 	added, err := rpn.full.PaychVoucherAdd(ctx, sharedutils.FromSharedAddress(paymentChannel), localVoucher, proof, sharedutils.FromSharedTokenAmount(expectedAmount))
 	return sharedutils.ToSharedTokenAmount(added), err
-}
\ No newline at end of file
+}
@@ -9,4 +9,9 @@ import (
 
 type Store interface {
 	AcquireSector(ctx context.Context, s abi.SectorID, existing sectorbuilder.SectorFileType, allocate sectorbuilder.SectorFileType, sealing bool) (sectorbuilder.SectorPaths, func(), error)
-}
\ No newline at end of file
+
+	// IsUnsealed reports whether the unsealed copy of the given piece range
+	// is already present in local storage, so callers can skip triggering
+	// an unseal before reading it.
+	IsUnsealed(ctx context.Context, s abi.SectorID, offset abi.PaddedPieceSize, size abi.PaddedPieceSize) (bool, error)
+}
@@ -0,0 +1,228 @@
+package sectorblocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	carv2bs "github.com/ipld/go-car/v2/blockstore"
+	ipld "github.com/ipld/go-ipld-prime"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-sectorbuilder"
+)
+
+// ClosableBlockstore is a blockstore.Blockstore that owns an underlying
+// resource (an open file, an mmap) which must be released once the
+// retrieval using it is done.
+type ClosableBlockstore interface {
+	blockstore.Blockstore
+	Close() error
+}
+
+// trackedBlockstore is a ClosableBlockstore shared by every concurrent
+// retrieval of the same piece, plus a count of how many callers are
+// currently holding a handle to it.
+type trackedBlockstore struct {
+	ClosableBlockstore
+	refs int
+}
+
+// blockstoreTracker keeps at most one open ClosableBlockstore per key so
+// that concurrent retrievals sharing that key (e.g. the same piece) reuse
+// one open CARv2 file instead of each opening their own. Every Get/Add
+// hands back a refcounted handle rather than the shared blockstore
+// itself: the underlying blockstore is only actually closed (and
+// forgotten) once every handle sharing it has been Close'd, so one
+// retrieval finishing can't yank the mmap out from under another still
+// in flight, and a fully-released piece doesn't linger as an open file
+// for the life of the process.
+type blockstoreTracker struct {
+	lk sync.Mutex
+	bs map[string]*trackedBlockstore
+}
+
+func newBlockstoreTracker() *blockstoreTracker {
+	return &blockstoreTracker{
+		bs: map[string]*trackedBlockstore{},
+	}
+}
+
+// Add starts tracking bs under key and returns a handle to it with a
+// refcount of one. It fails if key is already tracked; callers
+// discovering that race should Get the existing entry instead.
+func (bt *blockstoreTracker) Add(key string, bs ClosableBlockstore) (ClosableBlockstore, error) {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	if _, ok := bt.bs[key]; ok {
+		return nil, xerrors.Errorf("blockstore already tracked for key %s", key)
+	}
+
+	bt.bs[key] = &trackedBlockstore{ClosableBlockstore: bs, refs: 1}
+	return &trackerHandle{tracker: bt, key: key, ClosableBlockstore: bs}, nil
+}
+
+// Get returns a new handle to the blockstore tracked under key,
+// incrementing its refcount, or an error if nothing is tracked for key.
+func (bt *blockstoreTracker) Get(key string) (ClosableBlockstore, error) {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	tracked, ok := bt.bs[key]
+	if !ok {
+		return nil, xerrors.Errorf("no blockstore tracked for key %s", key)
+	}
+	tracked.refs++
+
+	return &trackerHandle{tracker: bt, key: key, ClosableBlockstore: tracked.ClosableBlockstore}, nil
+}
+
+// release drops one reference to the blockstore tracked under key,
+// closing and untracking it once the last reference is released.
+func (bt *blockstoreTracker) release(key string) error {
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+
+	tracked, ok := bt.bs[key]
+	if !ok {
+		return nil
+	}
+
+	tracked.refs--
+	if tracked.refs > 0 {
+		return nil
+	}
+
+	delete(bt.bs, key)
+	return tracked.Close()
+}
+
+// trackerHandle is a single caller's view of a blockstore shared through
+// blockstoreTracker. Close releases this caller's reference; the
+// underlying blockstore is only closed once every handle sharing it has
+// done the same.
+type trackerHandle struct {
+	ClosableBlockstore
+	tracker *blockstoreTracker
+	key     string
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (h *trackerHandle) Close() error {
+	h.closeOnce.Do(func() {
+		h.closeErr = h.tracker.release(h.key)
+	})
+	return h.closeErr
+}
+
+// SealedCARBlockstore opens the sector holding pieceCid as a CARv2 file
+// with an embedded index and returns a read-only blockstore over it. If
+// the sector's unsealed copy isn't already present locally, it calls
+// approveUnseal first and fails if approval is refused. It does not unseal
+// the sector itself: either way it opens the unsealed copy that the
+// store's AcquireSector hands back.
+//
+// If sel is non-nil, the returned blockstore only answers Get/Has for the
+// sub-DAG sel matches under the piece's payload root, so a client asking
+// for one file (or one HAMT directory) out of a piece doesn't cause the
+// whole piece to be streamed. onMatch, if non-nil, is called once per
+// block the selector walk matches, with that block's size, while this
+// call resolves the selector (before the blockstore is returned), so a
+// caller can account for what the selector matched (e.g. for payment
+// purposes). A
+// selector-scoped blockstore is opened fresh each call rather than
+// shared; pass sel (and onMatch) as nil to get the full-piece
+// blockstore, which is shared across concurrent retrievals of the same
+// piece, keyed by its CID. Every caller, shared or not, must Close the
+// blockstore it gets back once done with it: for the shared case that
+// only releases this caller's reference, and the underlying CARv2 file
+// and acquired sector lock are closed once the last sharer does so.
+func (sb *SectorBlocks) SealedCARBlockstore(pieceCid cid.Cid, sel ipld.Node, onMatch func(c cid.Cid, size uint64), approveUnseal func() error) (ClosableBlockstore, error) {
+	key := pieceCid.String()
+
+	if sel == nil {
+		if bs, err := sb.carStores.Get(key); err == nil {
+			return bs, nil
+		}
+	}
+
+	loc, err := sb.locatePiece(pieceCid)
+	if err != nil {
+		return nil, xerrors.Errorf("locating piece %s: %w", pieceCid, err)
+	}
+
+	ctx := context.TODO()
+
+	unsealed, err := sb.Store.IsUnsealed(ctx, loc.sector, loc.offset, loc.size)
+	if err != nil {
+		return nil, xerrors.Errorf("checking unseal state of sector %d: %w", loc.sector.Number, err)
+	}
+	if !unsealed {
+		if err := approveUnseal(); err != nil {
+			return nil, xerrors.Errorf("approving unseal of sector %d: %w", loc.sector.Number, err)
+		}
+	}
+
+	paths, done, err := sb.Store.AcquireSector(ctx, loc.sector, sectorbuilder.FTUnsealed, sectorbuilder.FTNone, false)
+	if err != nil {
+		return nil, xerrors.Errorf("acquiring unsealed sector %d: %w", loc.sector.Number, err)
+	}
+
+	carbs, err := carv2bs.OpenReadOnly(paths.Unsealed)
+	if err != nil {
+		done()
+		return nil, xerrors.Errorf("opening sector %d payload as CARv2: %w", loc.sector.Number, err)
+	}
+
+	cbs := &sectorCARBlockstore{
+		ReadOnly: carbs,
+		release:  done,
+	}
+
+	if sel == nil {
+		handle, err := sb.carStores.Add(key, cbs)
+		if err != nil {
+			// Lost a race with a concurrent retrieval of the same piece
+			// that tracked it first: close what we just opened and share
+			// theirs instead.
+			_ = cbs.Close()
+			return sb.carStores.Get(key)
+		}
+		return handle, nil
+	}
+
+	roots := carbs.Roots()
+	if len(roots) != 1 {
+		_ = cbs.Close()
+		return nil, xerrors.Errorf("expected a single payload root in piece %s, got %d", pieceCid, len(roots))
+	}
+
+	matched, err := selectorMatchedBlocks(ctx, cbs, roots[0], sel, onMatch)
+	if err != nil {
+		_ = cbs.Close()
+		return nil, xerrors.Errorf("resolving selector against piece %s: %w", pieceCid, err)
+	}
+
+	return &selectorFilteredBlockstore{
+		ClosableBlockstore: cbs,
+		matched:            matched,
+	}, nil
+}
+
+// sectorCARBlockstore pairs a CARv2 blockstore with the sector storage
+// lock it was opened under, so Close releases both the mmap/fd and the
+// acquired sector path in one step.
+type sectorCARBlockstore struct {
+	*carv2bs.ReadOnly
+	release func()
+}
+
+func (s *sectorCARBlockstore) Close() error {
+	err := s.ReadOnly.Close()
+	s.release()
+	return err
+}
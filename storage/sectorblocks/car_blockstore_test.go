@@ -0,0 +1,125 @@
+package sectorblocks
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// fakeClosableBlockstore is a minimal ClosableBlockstore for exercising
+// blockstoreTracker without a real CARv2 file.
+type fakeClosableBlockstore struct {
+	closed bool
+}
+
+func (f *fakeClosableBlockstore) Has(cid.Cid) (bool, error)         { return false, nil }
+func (f *fakeClosableBlockstore) Get(cid.Cid) (blocks.Block, error) { return nil, nil }
+func (f *fakeClosableBlockstore) GetSize(cid.Cid) (int, error)      { return 0, nil }
+func (f *fakeClosableBlockstore) Put(blocks.Block) error            { return nil }
+func (f *fakeClosableBlockstore) PutMany([]blocks.Block) error      { return nil }
+func (f *fakeClosableBlockstore) DeleteBlock(cid.Cid) error         { return nil }
+func (f *fakeClosableBlockstore) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	return nil, nil
+}
+func (f *fakeClosableBlockstore) HashOnRead(bool) {}
+func (f *fakeClosableBlockstore) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestBlockstoreTrackerAddAndGet(t *testing.T) {
+	bt := newBlockstoreTracker()
+	bs := &fakeClosableBlockstore{}
+
+	handle, err := bt.Add("piece-a", bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle.(*trackerHandle).ClosableBlockstore != bs {
+		t.Fatal("expected Add's handle to wrap the exact blockstore instance tracked")
+	}
+
+	got, err := bt.Get("piece-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.(*trackerHandle).ClosableBlockstore != bs {
+		t.Fatal("expected Get's handle to wrap the exact blockstore instance Add tracked")
+	}
+}
+
+func TestBlockstoreTrackerAddRejectsDuplicateKey(t *testing.T) {
+	bt := newBlockstoreTracker()
+
+	if _, err := bt.Add("piece-a", &fakeClosableBlockstore{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bt.Add("piece-a", &fakeClosableBlockstore{}); err == nil {
+		t.Fatal("expected Add to reject a second blockstore tracked under the same key")
+	}
+}
+
+func TestBlockstoreTrackerGetUntracked(t *testing.T) {
+	bt := newBlockstoreTracker()
+
+	if _, err := bt.Get("missing"); err == nil {
+		t.Fatal("expected Get to fail for an untracked key")
+	}
+}
+
+func TestBlockstoreTrackerClosesOnLastRelease(t *testing.T) {
+	bt := newBlockstoreTracker()
+	bs := &fakeClosableBlockstore{}
+
+	h1, err := bt.Add("piece-a", bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := bt.Get("piece-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bs.closed {
+		t.Fatal("expected the shared blockstore to stay open while another handle still holds it")
+	}
+	h3, err := bt.Get("piece-a")
+	if err != nil {
+		t.Fatal("expected the piece to still be tracked while a handle is outstanding")
+	}
+	if err := h3.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bs.closed {
+		t.Fatal("expected the shared blockstore to close once every handle released it")
+	}
+	if _, err := bt.Get("piece-a"); err == nil {
+		t.Fatal("expected the piece to no longer be tracked once every handle released it")
+	}
+}
+
+func TestBlockstoreTrackerHandleCloseIsIdempotent(t *testing.T) {
+	bt := newBlockstoreTracker()
+	bs := &fakeClosableBlockstore{}
+
+	handle, err := bt.Add("piece-a", bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
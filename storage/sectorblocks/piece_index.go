@@ -0,0 +1,90 @@
+package sectorblocks
+
+import (
+	"encoding/json"
+
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+)
+
+// DealInfo locates a stored copy of a piece: which sector it was sealed
+// into, at what offset and length, and under which deal.
+type DealInfo struct {
+	DealID   abi.DealID
+	SectorID abi.SectorID
+	Offset   abi.PaddedPieceSize
+	Length   abi.PaddedPieceSize
+}
+
+func pieceKey(pieceCid cid.Cid) datastore.Key {
+	return datastore.NewKey("/pieces/" + pieceCid.String())
+}
+
+func payloadKey(payloadCid cid.Cid) datastore.Key {
+	return datastore.NewKey("/payload/" + payloadCid.String())
+}
+
+// AddDealForPiece records that dealInfo's deal stored payloadCid inside
+// pieceCid, so a later retrieval can find the piece by either CID without
+// rescanning every sector.
+func (sb *SectorBlocks) AddDealForPiece(pieceCid, payloadCid cid.Cid, dealInfo DealInfo) error {
+	sb.pieceLk.Lock()
+	defer sb.pieceLk.Unlock()
+
+	deals, err := sb.GetDealsForPiece(pieceCid)
+	if err != nil && !xerrors.Is(err, datastore.ErrNotFound) {
+		return xerrors.Errorf("loading existing deals for piece %s: %w", pieceCid, err)
+	}
+	deals = append(deals, dealInfo)
+
+	b, err := json.Marshal(deals)
+	if err != nil {
+		return xerrors.Errorf("encoding deals for piece %s: %w", pieceCid, err)
+	}
+
+	if err := sb.ds.Put(pieceKey(pieceCid), b); err != nil {
+		return xerrors.Errorf("storing deals for piece %s: %w", pieceCid, err)
+	}
+
+	if err := sb.ds.Put(payloadKey(payloadCid), pieceCid.Bytes()); err != nil {
+		return xerrors.Errorf("storing piece for payload %s: %w", payloadCid, err)
+	}
+
+	return nil
+}
+
+// GetDealsForPiece returns every deal on record as having stored pieceCid.
+func (sb *SectorBlocks) GetDealsForPiece(pieceCid cid.Cid) ([]DealInfo, error) {
+	b, err := sb.ds.Get(pieceKey(pieceCid))
+	if err != nil {
+		if xerrors.Is(err, datastore.ErrNotFound) {
+			return nil, xerrors.Errorf("no deals found for piece %s: %w", pieceCid, err)
+		}
+		return nil, err
+	}
+
+	var deals []DealInfo
+	if err := json.Unmarshal(b, &deals); err != nil {
+		return nil, xerrors.Errorf("decoding deals for piece %s: %w", pieceCid, err)
+	}
+
+	return deals, nil
+}
+
+// LookupPieceForCID returns the piece a payload root was stored under, so
+// a client can retrieve by the root CID it actually wants instead of
+// having to already know which piece contains it.
+func (sb *SectorBlocks) LookupPieceForCID(payloadCid cid.Cid) (cid.Cid, error) {
+	b, err := sb.ds.Get(payloadKey(payloadCid))
+	if err != nil {
+		if xerrors.Is(err, datastore.ErrNotFound) {
+			return cid.Undef, xerrors.Errorf("no piece found for payload %s", payloadCid)
+		}
+		return cid.Undef, err
+	}
+
+	return cid.Cast(b)
+}
@@ -0,0 +1,93 @@
+package sectorblocks
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+)
+
+func testCid(t *testing.T, data string) cid.Cid {
+	t.Helper()
+
+	h, err := mh.Sum([]byte(data), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+func testSectorBlocks(t *testing.T) *SectorBlocks {
+	t.Helper()
+	return NewSectorBlocks(nil, datastore.NewMapDatastore())
+}
+
+func TestAddAndGetDealsForPiece(t *testing.T) {
+	sb := testSectorBlocks(t)
+	pieceCid := testCid(t, "piece")
+	payloadCid := testCid(t, "payload")
+
+	deal := DealInfo{DealID: 1, SectorID: abi.SectorID{Miner: 1, Number: 2}, Offset: 0, Length: 128}
+	if err := sb.AddDealForPiece(pieceCid, payloadCid, deal); err != nil {
+		t.Fatal(err)
+	}
+
+	deals, err := sb.GetDealsForPiece(pieceCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deals) != 1 || deals[0] != deal {
+		t.Fatalf("expected one matching deal, got %+v", deals)
+	}
+
+	got, err := sb.LookupPieceForCID(payloadCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(pieceCid) {
+		t.Fatalf("expected piece %s, got %s", pieceCid, got)
+	}
+}
+
+func TestAddDealForPieceAppendsToExistingEntry(t *testing.T) {
+	sb := testSectorBlocks(t)
+	pieceCid := testCid(t, "piece")
+	payloadCid := testCid(t, "payload")
+
+	d1 := DealInfo{DealID: 1, SectorID: abi.SectorID{Miner: 1, Number: 2}}
+	d2 := DealInfo{DealID: 2, SectorID: abi.SectorID{Miner: 1, Number: 3}}
+
+	if err := sb.AddDealForPiece(pieceCid, payloadCid, d1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.AddDealForPiece(pieceCid, payloadCid, d2); err != nil {
+		t.Fatal(err)
+	}
+
+	deals, err := sb.GetDealsForPiece(pieceCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deals) != 2 || deals[0] != d1 || deals[1] != d2 {
+		t.Fatalf("expected both deals recorded in order, got %+v", deals)
+	}
+}
+
+func TestGetDealsForPieceUnknownCID(t *testing.T) {
+	sb := testSectorBlocks(t)
+
+	if _, err := sb.GetDealsForPiece(testCid(t, "unknown")); err == nil {
+		t.Fatal("expected an error looking up a piece with no recorded deals")
+	}
+}
+
+func TestLookupPieceForCIDUnknownCID(t *testing.T) {
+	sb := testSectorBlocks(t)
+
+	if _, err := sb.LookupPieceForCID(testCid(t, "unknown")); err == nil {
+		t.Fatal("expected an error looking up a payload with no recorded piece")
+	}
+}
@@ -0,0 +1,150 @@
+package sectorblocks
+
+import (
+	"context"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/storage/sealmgr/stores"
+)
+
+// pieceLocation records where a piece's payload lives within a sector so
+// it can be found again for a later retrieval.
+type pieceLocation struct {
+	sector abi.SectorID
+	offset abi.PaddedPieceSize
+	size   abi.PaddedPieceSize
+}
+
+// SectorBlocks tracks which pieces live in which sectors and serves reads
+// for retrieval deals out of sealed (or unsealing) storage.
+type SectorBlocks struct {
+	Store stores.Store
+
+	// ds persists the piece/payload index (see piece_index.go) so it
+	// survives restarts instead of having to be rebuilt by rescanning
+	// sectors.
+	ds datastore.Batching
+	// pieceLk serializes the index's read-modify-write updates in
+	// AddDealForPiece so concurrent deals for the same piece don't race
+	// and clobber each other's entry.
+	pieceLk sync.Mutex
+
+	carStores *blockstoreTracker
+}
+
+func NewSectorBlocks(store stores.Store, ds datastore.Batching) *SectorBlocks {
+	return &SectorBlocks{
+		Store:     store,
+		ds:        ds,
+		carStores: newBlockstoreTracker(),
+	}
+}
+
+func (sb *SectorBlocks) GetSize(pieceCid cid.Cid) (uint64, error) {
+	loc, err := sb.locatePiece(pieceCid)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(loc.size), nil
+}
+
+// locatePiece returns where to read pieceCid's payload from, using
+// whichever deal the persistent index has on record for it first.
+func (sb *SectorBlocks) locatePiece(pieceCid cid.Cid) (pieceLocation, error) {
+	deals, err := sb.GetDealsForPiece(pieceCid)
+	if err != nil {
+		return pieceLocation{}, err
+	}
+	if len(deals) == 0 {
+		return pieceLocation{}, xerrors.Errorf("no deals recorded for piece %s", pieceCid)
+	}
+
+	d := deals[0]
+	return pieceLocation{
+		sector: d.SectorID,
+		offset: d.Offset,
+		size:   d.Length,
+	}, nil
+}
+
+// SealedBlockstore returns a blockstore that serves every read through
+// SealedCARBlockstore for the piece holding the requested block, taking a
+// handle on that piece's shared CARv2 blockstore and releasing it again
+// after the one read. Prefer SealedCARBlockstore, which lets a caller keep
+// one handle for a whole retrieval instead.
+func (sb *SectorBlocks) SealedBlockstore(approveUnseal func() error) blockstore.Blockstore {
+	return &unsealingBlockstore{
+		sb:            sb,
+		approveUnseal: approveUnseal,
+	}
+}
+
+// unsealingBlockstore is the legacy fallback: every read opens (or reuses)
+// the CARv2 blockstore for whichever piece the block belongs to.
+type unsealingBlockstore struct {
+	sb            *SectorBlocks
+	approveUnseal func() error
+}
+
+// Has and Get both take the CID of a block, not the piece's own CID, and
+// find the piece through the piece index. The index records only each
+// deal's payload root, so Has reports any other block of a payload DAG as
+// absent and Get fails for it.
+func (u *unsealingBlockstore) Has(c cid.Cid) (bool, error) {
+	pieceCid, err := u.sb.LookupPieceForCID(c)
+	if err != nil {
+		return false, nil
+	}
+	_, err = u.sb.locatePiece(pieceCid)
+	return err == nil, nil
+}
+
+func (u *unsealingBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	pieceCid, err := u.sb.LookupPieceForCID(c)
+	if err != nil {
+		return nil, xerrors.Errorf("looking up piece for %s: %w", c, err)
+	}
+
+	bs, err := u.sb.SealedCARBlockstore(pieceCid, nil, nil, u.approveUnseal)
+	if err != nil {
+		return nil, xerrors.Errorf("opening piece %s: %w", pieceCid, err)
+	}
+	defer bs.Close()
+
+	return bs.Get(c)
+}
+
+func (u *unsealingBlockstore) GetSize(c cid.Cid) (int, error) {
+	blk, err := u.Get(c)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func (u *unsealingBlockstore) Put(blocks.Block) error {
+	return xerrors.Errorf("unsealingBlockstore is read-only")
+}
+
+func (u *unsealingBlockstore) PutMany([]blocks.Block) error {
+	return xerrors.Errorf("unsealingBlockstore is read-only")
+}
+
+func (u *unsealingBlockstore) DeleteBlock(cid.Cid) error {
+	return xerrors.Errorf("unsealingBlockstore is read-only")
+}
+
+func (u *unsealingBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	return nil, xerrors.Errorf("unsealingBlockstore does not support AllKeysChan")
+}
+
+func (u *unsealingBlockstore) HashOnRead(bool) {}
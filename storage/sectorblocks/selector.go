@@ -0,0 +1,101 @@
+package sectorblocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"golang.org/x/xerrors"
+)
+
+// selectorMatchedBlocks walks root under sel and returns the set of CIDs
+// the selector reaches, so a retrieval can serve only the sub-DAG a
+// client asked for (e.g. one file out of a HAMT directory) instead of
+// the whole piece. onMatch, if non-nil, is called once per matched block
+// with its size as the walk reaches it, so a caller can account for what
+// the selector matched.
+func selectorMatchedBlocks(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, sel ipld.Node, onMatch func(c cid.Cid, size uint64)) (map[cid.Cid]struct{}, error) {
+	parsed, err := selector.ParseSelector(sel)
+	if err != nil {
+		return nil, xerrors.Errorf("parsing selector: %w", err)
+	}
+
+	return walkMatching(ctx, bs, root, parsed, onMatch)
+}
+
+func walkMatching(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, sel selector.Selector, onMatch func(c cid.Cid, size uint64)) (map[cid.Cid]struct{}, error) {
+	matched := map[cid.Cid]struct{}{}
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(_ ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, xerrors.Errorf("unsupported link type %T", lnk)
+		}
+
+		blk, err := bs.Get(cl.Cid)
+		if err != nil {
+			return nil, xerrors.Errorf("loading %s: %w", cl.Cid, err)
+		}
+
+		if _, seen := matched[cl.Cid]; !seen {
+			matched[cl.Cid] = struct{}{}
+			if onMatch != nil {
+				onMatch(cl.Cid, uint64(len(blk.RawData())))
+			}
+		}
+
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	rootNode, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, basicnode.Prototype.Any)
+	if err != nil {
+		return nil, xerrors.Errorf("loading selector root %s: %w", root, err)
+	}
+
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:        ctx,
+			LinkSystem: lsys,
+		},
+	}
+
+	err = progress.WalkMatching(rootNode, sel, func(traversal.Progress, ipld.Node) error {
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("walking selector from %s: %w", root, err)
+	}
+
+	return matched, nil
+}
+
+// selectorFilteredBlockstore only answers Get/Has for blocks a selector
+// walk reached, so callers can't pull more out of a piece than the
+// selector describes.
+type selectorFilteredBlockstore struct {
+	ClosableBlockstore
+	matched map[cid.Cid]struct{}
+}
+
+func (s *selectorFilteredBlockstore) Has(c cid.Cid) (bool, error) {
+	if _, ok := s.matched[c]; !ok {
+		return false, nil
+	}
+	return s.ClosableBlockstore.Has(c)
+}
+
+func (s *selectorFilteredBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	if _, ok := s.matched[c]; !ok {
+		return nil, blockstore.ErrNotFound
+	}
+	return s.ClosableBlockstore.Get(c)
+}
@@ -0,0 +1,46 @@
+package sectorblocks
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// matchOnlyBlockstore answers Get/Has for any CID, so tests can tell
+// selectorFilteredBlockstore's own filtering apart from the backing
+// blockstore's.
+type matchOnlyBlockstore struct {
+	fakeClosableBlockstore
+}
+
+func (m *matchOnlyBlockstore) Has(cid.Cid) (bool, error) { return true, nil }
+
+func (m *matchOnlyBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	return blocks.NewBlockWithCid([]byte("data"), c)
+}
+
+func TestSelectorFilteredBlockstoreOnlyServesMatchedCIDs(t *testing.T) {
+	matchedCid := testCid(t, "matched")
+	unmatchedCid := testCid(t, "unmatched")
+
+	sfb := &selectorFilteredBlockstore{
+		ClosableBlockstore: &matchOnlyBlockstore{},
+		matched:            map[cid.Cid]struct{}{matchedCid: {}},
+	}
+
+	if ok, err := sfb.Has(matchedCid); err != nil || !ok {
+		t.Fatalf("expected Has(matched) to be true, got (%v, %v)", ok, err)
+	}
+	if ok, err := sfb.Has(unmatchedCid); err != nil || ok {
+		t.Fatalf("expected Has(unmatched) to be false, got (%v, %v)", ok, err)
+	}
+
+	if _, err := sfb.Get(matchedCid); err != nil {
+		t.Fatalf("expected Get(matched) to succeed, got %v", err)
+	}
+	if _, err := sfb.Get(unmatchedCid); err != blockstore.ErrNotFound {
+		t.Fatalf("expected Get(unmatched) to fail with ErrNotFound, got %v", err)
+	}
+}